@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
+	kitlog "github.com/go-kit/log"
 	"github.com/ncabatoff/go-vmguestlib/vmguestlib"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 )
 
 const metric_name_pfx = "vmwareguest_"
@@ -31,6 +40,16 @@ var (
 		"events e.g. snapshot, vmotion, etc",
 		[]string{},
 		nil)
+	scrapeSuccessDesc = prometheus.NewDesc(
+		"vmwareguest_scrape_success",
+		"1 if the last background refresh of vmguestlib info succeeded, 0 otherwise",
+		[]string{},
+		nil)
+	scrapeDurationDesc = prometheus.NewDesc(
+		"vmwareguest_last_scrape_duration_seconds",
+		"time it took to refresh vmguestlib info on the last background refresh",
+		[]string{},
+		nil)
 )
 
 func init() {
@@ -44,36 +63,75 @@ func init() {
 }
 
 type Collector struct {
-	session *vmguestlib.Session
-	errors  int
-	events  int
+	sampler *Sampler
 }
 
-// Return a new Collector.  If we can't initialize the vmguestlib session,
-// we'll return both a collector and an error, but the collector will publish
-// only the isguest metric (with a value of 0).
-func NewCollector() (*Collector, error) {
+// NewCollector returns a new Collector and starts its background Sampler.
+// If we can't initialize the vmguestlib session immediately, we'll return
+// both a collector and an error, but the collector will keep retrying to
+// open a session on its own schedule.  Until it succeeds, the collector
+// publishes isguest and scrape_success with a value of 0, along with the
+// scrape duration, events and collecterrors metrics, but none of the
+// vmguestlib metrics.
+func NewCollector(interval time.Duration) (*Collector, error) {
 	s, err := vmguestlib.NewSession()
 	if err != nil {
 		s = nil // just to be sure
 	}
-	return &Collector{session: s}, err
+	sampler := NewSampler(s, interval)
+	sampler.Start()
+	return &Collector{sampler: sampler}, err
+}
+
+// Close stops the Collector's background Sampler.
+func (c *Collector) Close() {
+	c.sampler.Stop()
 }
 
 func main() {
 	var (
-		listenAddress = flag.String("web.listen-address", ":9263", "Address on which to expose metrics and web interface.")
-		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		listenAddress   = flag.String("web.listen-address", ":9263", "Address on which to expose metrics and web interface.")
+		metricsPath     = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		webConfigFile   = flag.String("web.config.file", "", "Path to configuration file that can enable TLS or authentication.")
+		collectInterval = flag.Duration("collect.interval", 10*time.Second, "Interval at which to refresh vmguestlib info in the background.")
+		source          = flag.String("source", "guestlib", "Where to collect metrics from: \"guestlib\" (this VM's vmguestlib session) or \"vcenter\" (all VMs visible to a vCenter/ESXi host).")
+		vcenterURL      = flag.String("vcenter.url", "", "vCenter or ESXi URL, e.g. https://vcenter.example.com/sdk. Required when -source=vcenter.")
+		vcenterUser     = flag.String("vcenter.username", "", "vCenter or ESXi username. Required when -source=vcenter.")
+		vcenterPassword = flag.String("vcenter.password", "", "vCenter or ESXi password. Required when -source=vcenter.")
+		vcenterInsecure = flag.Bool("vcenter.insecure", false, "Skip TLS certificate verification when connecting to vCenter.")
+		vcenterTimeout  = flag.Duration("vcenter.timeout", 30*time.Second, "Timeout for the vCenter connect+list+query round trip on each scrape. Only used when -source=vcenter.")
 	)
 	flag.Parse()
 
-	c, err := NewCollector()
-	if err != nil {
-		log.Printf("Error creating collector: %v", err)
+	var closers []func()
+	switch *source {
+	case "guestlib":
+		c, err := NewCollector(*collectInterval)
+		if err != nil {
+			log.Printf("Error creating collector: %v", err)
+		}
+		prometheus.MustRegister(c)
+		closers = append(closers, c.Close)
+	case "vcenter":
+		vc, err := NewVCenterCollector(VCenterConfig{
+			URL:      *vcenterURL,
+			Username: *vcenterUser,
+			Password: *vcenterPassword,
+			Insecure: *vcenterInsecure,
+			Timeout:  *vcenterTimeout,
+		})
+		if err != nil {
+			log.Fatalf("Error creating vCenter collector: %v", err)
+		}
+		prometheus.MustRegister(vc)
+	default:
+		log.Fatalf("Unknown -source %q, must be \"guestlib\" or \"vcenter\"", *source)
 	}
-	prometheus.MustRegister(c)
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollections(collectors.GoRuntimeMetricsCollection)))
+	prometheus.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 
-	http.Handle(*metricsPath, prometheus.Handler())
+	http.Handle(*metricsPath, promhttp.Handler())
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -84,62 +142,87 @@ func main() {
 			</body>
 			</html>`))
 	})
-	http.ListenAndServe(*listenAddress, nil)
+
+	server := &http.Server{Addr: *listenAddress}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		for _, closer := range closers {
+			closer()
+		}
+		server.Shutdown(context.Background())
+	}()
+
+	logger := kitlog.NewLogfmtLogger(os.Stderr)
+	if err := web.ListenAndServe(server, &web.FlagConfig{WebConfigFile: webConfigFile}, logger); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Error starting server: %v", err)
+	}
 }
 
-// Collect implements prometheus.Collector.
+// Collect implements prometheus.Collector.  It never blocks on vmguestlib
+// itself; it just reports whatever the background Sampler last cached.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
-	isguest := 0
-	if c.session != nil {
+	snap := c.sampler.Snapshot()
+
+	isguest := 0.0
+	if snap.Healthy {
 		isguest = 1
 	}
 	ch <- prometheus.MustNewConstMetric(isGuestDesc,
 		prometheus.GaugeValue,
-		float64(isguest))
-
-	if c.session == nil {
-		return
-	}
+		isguest)
 
-	if event, err := c.session.RefreshInfo(); err != nil {
-		if err != nil {
-			log.Printf("An error occured: %v", err)
-		}
-		os.Exit(1)
-	} else if event {
-		c.events++
+	success := 0.0
+	if snap.LastSuccess {
+		success = 1
 	}
+	ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc,
+		prometheus.GaugeValue,
+		success)
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc,
+		prometheus.GaugeValue,
+		snap.LastDuration.Seconds())
 
-	for i, m := range metrics {
-		val, err := m.Get(c.session)
-		if err != nil {
-			// log.Printf("error reading %s: %v", m.name, err)
-			c.errors++
-		} else {
-			ch <- prometheus.MustNewConstMetric(descs[i], m.ValueType, val)
+	if snap.LastSuccess {
+		for i, m := range metrics {
+			if snap.ValueErrs[i] != nil {
+				continue
+			}
+			pm := prometheus.MustNewConstMetric(descs[i], m.ValueType, snap.Values[i])
+			if m.ValueType == prometheus.CounterValue && snap.LastEvent {
+				if em, err := prometheus.NewMetricWithExemplars(pm, prometheus.Exemplar{
+					Value:  snap.Values[i],
+					Labels: eventExemplarLabels(snap.LastEventSeq),
+				}); err == nil {
+					pm = em
+				}
+			}
+			ch <- pm
 		}
 	}
 
 	ch <- prometheus.MustNewConstMetric(eventsDesc,
 		prometheus.CounterValue,
-		float64(c.events))
+		float64(snap.Events))
 	ch <- prometheus.MustNewConstMetric(collecterrsDesc,
 		prometheus.CounterValue,
-		float64(c.errors))
+		float64(snap.Errors))
 }
 
-// Describe implements prometheus.Collector.
+// Describe implements prometheus.Collector.  All descriptors are always
+// declared since session health, and therefore which metrics are
+// populated, can change at runtime as the Sampler reconnects.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- isGuestDesc
-	if c.session == nil {
-		return
-	}
-
+	ch <- scrapeSuccessDesc
+	ch <- scrapeDurationDesc
+	ch <- eventsDesc
+	ch <- collecterrsDesc
 	for _, d := range descs {
 		ch <- d
 	}
-	ch <- eventsDesc
-	ch <- collecterrsDesc
 }
 
 type (
@@ -203,6 +286,35 @@ func msmetric(getter getf64, name, desc string) metric {
 	return metric{getter, name, desc, 0.001, "seconds", prometheus.CounterValue}
 }
 
+// exemplarLabelRuneBudget is the OpenMetrics limit on the combined length
+// of an exemplar's label names and values, in runes.
+const exemplarLabelRuneBudget = 128
+
+// eventExemplarLabels builds the labels attached to an exemplar linking a
+// counter-typed sample to the vmguestlib event observed during the same
+// scrape, dropping the sequence number if that would blow the OpenMetrics
+// 128-rune exemplar label budget.  vmguestlib's RefreshInfo only reports
+// that an event happened, not which kind (vmotion vs. snapshot), so we
+// can't label that distinction here.
+func eventExemplarLabels(seq uint64) prometheus.Labels {
+	labels := prometheus.Labels{
+		"event": "event",
+		"seq":   strconv.FormatUint(seq, 10),
+	}
+	if exemplarLabelRunes(labels) > exemplarLabelRuneBudget {
+		delete(labels, "seq")
+	}
+	return labels
+}
+
+func exemplarLabelRunes(labels prometheus.Labels) int {
+	n := 0
+	for k, v := range labels {
+		n += utf8.RuneCountInString(k) + utf8.RuneCountInString(v)
+	}
+	return n
+}
+
 func (gm metric) prometheus_name() string {
 	name := metric_name_pfx + gm.name
 	if gm.unit != "" {
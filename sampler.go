@@ -0,0 +1,189 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ncabatoff/go-vmguestlib/vmguestlib"
+)
+
+// maxConsecutiveErrors is the number of consecutive RefreshInfo failures we
+// tolerate before tearing down and reopening the vmguestlib session, so a
+// VMware Tools restart or vmotion doesn't require restarting the exporter.
+const maxConsecutiveErrors = 3
+
+// Sampler refreshes a vmguestlib session on a fixed interval in the
+// background and caches the results, so that a Prometheus scrape never
+// blocks on the underlying cgo call.
+type Sampler struct {
+	interval time.Duration
+
+	mu                sync.Mutex
+	session           *vmguestlib.Session
+	healthy           bool
+	values            []float64
+	valueErrs         []error
+	events            int
+	errors            int
+	lastSuccess       bool
+	lastDuration      time.Duration
+	consecutiveErrors int
+	// lastEvent/lastEventSeq latch the most recent vmguestlib event until
+	// Snapshot reads and clears them, so an event seen on one background
+	// tick survives to the next Collect even if a later tick in between
+	// (collect.interval is typically shorter than scrape_interval) sees
+	// no event of its own.
+	lastEvent    bool
+	lastEventSeq uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// SamplerSnapshot is a point-in-time copy of a Sampler's cached state, safe
+// to read without holding the Sampler's lock.
+type SamplerSnapshot struct {
+	Healthy      bool
+	Values       []float64
+	ValueErrs    []error
+	Events       int
+	Errors       int
+	LastSuccess  bool
+	LastDuration time.Duration
+	LastEvent    bool
+	LastEventSeq uint64
+}
+
+// NewSampler returns a Sampler that will refresh s every interval once
+// Start is called.  s may be nil, in which case the sampler tries to open
+// its own session on the next sample.
+func NewSampler(s *vmguestlib.Session, interval time.Duration) *Sampler {
+	return &Sampler{
+		interval:  interval,
+		session:   s,
+		healthy:   s != nil,
+		values:    make([]float64, len(metrics)),
+		valueErrs: make([]error, len(metrics)),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start takes an initial sample and begins the background refresh loop.
+func (s *Sampler) Start() {
+	s.sample()
+	go s.run()
+}
+
+// Stop terminates the background refresh loop and waits for it to exit.
+func (s *Sampler) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Sampler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sample()
+		}
+	}
+}
+
+// sample refreshes the session once, reopening it if it's been failing
+// repeatedly, and caches the results for Snapshot to return.
+func (s *Sampler) sample() {
+	s.mu.Lock()
+	session := s.session
+	s.mu.Unlock()
+
+	if session == nil {
+		var err error
+		session, err = vmguestlib.NewSession()
+		if err != nil {
+			log.Printf("Error opening vmguestlib session: %v", err)
+			s.mu.Lock()
+			s.healthy = false
+			s.lastSuccess = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Lock()
+		s.session = session
+		s.consecutiveErrors = 0
+		s.mu.Unlock()
+	}
+
+	start := time.Now()
+	event, err := session.RefreshInfo()
+	duration := time.Since(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastDuration = duration
+	if err != nil {
+		log.Printf("Error refreshing vmguestlib info: %v", err)
+		s.errors++
+		s.consecutiveErrors++
+		s.lastSuccess = false
+		s.healthy = false
+		if s.consecutiveErrors >= maxConsecutiveErrors {
+			log.Printf("%d consecutive vmguestlib errors, reopening session", s.consecutiveErrors)
+			session.Close()
+			s.session = nil
+			s.consecutiveErrors = 0
+		}
+		return
+	}
+
+	if event {
+		s.events++
+		s.lastEventSeq = uint64(s.events)
+		s.lastEvent = true
+	}
+	s.consecutiveErrors = 0
+	s.lastSuccess = true
+	s.healthy = true
+
+	for i, m := range metrics {
+		val, err := m.Get(session)
+		s.valueErrs[i] = err
+		if err != nil {
+			s.errors++
+		} else {
+			s.values[i] = val
+		}
+	}
+}
+
+// Snapshot returns a consistent copy of the most recently sampled state.
+// Reading a latched event consumes it, so the next Snapshot won't report
+// the same event twice.
+func (s *Sampler) Snapshot() SamplerSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]float64, len(s.values))
+	copy(values, s.values)
+	valueErrs := make([]error, len(s.valueErrs))
+	copy(valueErrs, s.valueErrs)
+	snap := SamplerSnapshot{
+		Healthy:      s.healthy,
+		Values:       values,
+		ValueErrs:    valueErrs,
+		Events:       s.events,
+		Errors:       s.errors,
+		LastSuccess:  s.lastSuccess,
+		LastDuration: s.lastDuration,
+		LastEvent:    s.lastEvent,
+		LastEventSeq: s.lastEventSeq,
+	}
+	s.lastEvent = false
+	return snap
+}
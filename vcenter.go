@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/performance"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// vcenterCounters are the govmomi performance counter names we request for
+// every VM in the inventory, in the same order as vcenterMetricDescs.
+var vcenterCounters = []string{
+	"cpu.usage.average",
+	"mem.active.average",
+	"mem.swapped.average",
+	"disk.usage.average",
+	"net.throughput.usage.average",
+}
+
+var vcenterMetricDescs = []*prometheus.Desc{
+	prometheus.NewDesc(metric_name_pfx+"vcenter_cpu_usage_ratio",
+		"VM CPU usage as a fraction of the host's available CPU, from cpu.usage.average.",
+		[]string{"vm", "cluster", "host"}, nil),
+	prometheus.NewDesc(metric_name_pfx+"vcenter_mem_active_bytes",
+		"VM active memory, from mem.active.average.",
+		[]string{"vm", "cluster", "host"}, nil),
+	prometheus.NewDesc(metric_name_pfx+"vcenter_mem_swapped_bytes",
+		"VM swapped memory, from mem.swapped.average.",
+		[]string{"vm", "cluster", "host"}, nil),
+	prometheus.NewDesc(metric_name_pfx+"vcenter_disk_usage_bytes_per_second",
+		"VM disk I/O rate, from disk.usage.average.",
+		[]string{"vm", "cluster", "host"}, nil),
+	prometheus.NewDesc(metric_name_pfx+"vcenter_net_throughput_bytes_per_second",
+		"VM network throughput, from net.throughput.usage.average.",
+		[]string{"vm", "cluster", "host"}, nil),
+}
+
+// vcenterCounterMultipliers converts each counter in vcenterCounters from
+// its native vSphere PerfCounterInfo unit into the unit promised by the
+// corresponding desc above: cpu.usage.average is reported in hundredths of
+// a percent, and the KB/KBps counters need scaling up to bytes/bytes-per-second.
+var vcenterCounterMultipliers = []float64{
+	1.0 / 10000, // cpu.usage.average: 0.01% -> ratio
+	1024,        // mem.active.average: KB -> bytes
+	1024,        // mem.swapped.average: KB -> bytes
+	1024,        // disk.usage.average: KBps -> bytes/sec
+	1024,        // net.throughput.usage.average: KBps -> bytes/sec
+}
+
+// logoutTimeout bounds the best-effort session logout issued after each
+// Collect, independent of that scrape's own deadline.
+const logoutTimeout = 5 * time.Second
+
+// VCenterConfig holds the connection details for VCenterCollector.
+type VCenterConfig struct {
+	URL      string
+	Username string
+	Password string
+	Insecure bool
+	Timeout  time.Duration
+}
+
+// VCenterCollector scrapes per-VM performance counters from a vCenter or
+// ESXi host via govmomi, as an alternative to the vmguestlib-based
+// Collector for deployments that want one exporter per cluster rather
+// than one exporter per guest.
+type VCenterCollector struct {
+	cfg VCenterConfig
+}
+
+// NewVCenterCollector validates cfg and returns a VCenterCollector.  The
+// govmomi client itself is opened fresh on every Collect, since a scrape
+// interval of minutes is a poor fit for holding a long-lived session open
+// across an unreliable network link to vCenter.
+func NewVCenterCollector(cfg VCenterConfig) (*VCenterCollector, error) {
+	if cfg.URL == "" || cfg.Username == "" || cfg.Password == "" {
+		return nil, errors.New("vCenter URL, username and password are all required")
+	}
+	if _, err := soap.ParseURL(cfg.URL); err != nil {
+		return nil, err
+	}
+	return &VCenterCollector{cfg: cfg}, nil
+}
+
+// Describe implements prometheus.Collector.
+func (c *VCenterCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range vcenterMetricDescs {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *VCenterCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+
+	client, err := c.connect(ctx)
+	if err != nil {
+		log.Printf("Error connecting to vCenter at %s: %v", c.cfg.URL, err)
+		return
+	}
+	defer func() {
+		// ctx's deadline is tied to the scrape; by the time we get here on a
+		// scrape that ran close to it, it may already be expired, which
+		// would make Logout fail silently and leak the session on the
+		// vCenter side. Give the logout its own short-lived budget instead.
+		logoutCtx, logoutCancel := context.WithTimeout(context.Background(), logoutTimeout)
+		defer logoutCancel()
+		client.Logout(logoutCtx)
+	}()
+
+	vms, err := c.listVMs(ctx, client)
+	if err != nil {
+		log.Printf("Error listing VMs from vCenter at %s: %v", c.cfg.URL, err)
+		return
+	}
+
+	hosts, clusters := c.hostAndClusterNames(ctx, client, vms)
+
+	names := make(map[types.ManagedObjectReference]string, len(vms))
+	refs := make([]types.ManagedObjectReference, 0, len(vms))
+	for _, vm := range vms {
+		names[vm.Self] = vm.Name
+		refs = append(refs, vm.Self)
+	}
+
+	perfManager := performance.NewManager(client.Client)
+	metricIDs, err := perfManager.CounterInfoByName(ctx)
+	if err != nil {
+		log.Printf("Error fetching vCenter performance counter metadata: %v", err)
+		return
+	}
+
+	querySpecs := make([]types.PerfQuerySpec, 0, len(refs))
+	for _, ref := range refs {
+		var ids []types.PerfMetricId
+		for _, name := range vcenterCounters {
+			if info, ok := metricIDs[name]; ok {
+				ids = append(ids, types.PerfMetricId{CounterId: info.Key, Instance: ""})
+			}
+		}
+		querySpecs = append(querySpecs, types.PerfQuerySpec{
+			Entity:     ref,
+			MetricId:   ids,
+			IntervalId: 20,
+			MaxSample:  1,
+		})
+	}
+
+	samples, err := perfManager.Query(ctx, querySpecs)
+	if err != nil {
+		log.Printf("Error querying vCenter performance counters: %v", err)
+		return
+	}
+
+	results, err := perfManager.ToMetricSeries(ctx, samples)
+	if err != nil {
+		log.Printf("Error decoding vCenter performance counters: %v", err)
+		return
+	}
+
+	for _, result := range results {
+		vmName := names[result.Entity]
+		cluster := clusters[result.Entity]
+		host := hosts[result.Entity]
+		for _, series := range result.Value {
+			i := counterIndex(series.Name)
+			if i < 0 || len(series.Value) == 0 {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(vcenterMetricDescs[i],
+				prometheus.GaugeValue,
+				float64(series.Value[len(series.Value)-1])*vcenterCounterMultipliers[i],
+				vmName, cluster, host)
+		}
+	}
+}
+
+func counterIndex(name string) int {
+	for i, n := range vcenterCounters {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *VCenterCollector) connect(ctx context.Context) (*govmomi.Client, error) {
+	u, err := soap.ParseURL(c.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.User = url.UserPassword(c.cfg.Username, c.cfg.Password)
+	return govmomi.NewClient(ctx, u, c.cfg.Insecure)
+}
+
+func (c *VCenterCollector) listVMs(ctx context.Context, client *govmomi.Client) ([]mo.VirtualMachine, error) {
+	viewManager := view.NewManager(client.Client)
+	cv, err := viewManager.CreateContainerView(ctx, client.ServiceContent.RootFolder, []string{"VirtualMachine"}, true)
+	if err != nil {
+		return nil, err
+	}
+	defer cv.Destroy(ctx)
+
+	var vms []mo.VirtualMachine
+	err = cv.Retrieve(ctx, []string{"VirtualMachine"}, []string{"name", "runtime.host", "resourcePool"}, &vms)
+	return vms, err
+}
+
+// hostAndClusterNames resolves the host and cluster name for every VM with
+// two batched property-collector calls (one for all distinct hosts, one
+// for all distinct clusters) rather than a pair of round trips per VM, so
+// a Collect against a large cluster stays within its scrape timeout.  Any
+// VM whose host or cluster can't be resolved just gets an empty label
+// rather than failing the whole scrape.
+func (c *VCenterCollector) hostAndClusterNames(ctx context.Context, client *govmomi.Client, vms []mo.VirtualMachine) (hostNames, clusterNames map[types.ManagedObjectReference]string) {
+	hostNames = make(map[types.ManagedObjectReference]string, len(vms))
+	clusterNames = make(map[types.ManagedObjectReference]string, len(vms))
+
+	hostRefSet := make(map[types.ManagedObjectReference]bool)
+	for _, vm := range vms {
+		if vm.Runtime.Host != nil {
+			hostRefSet[*vm.Runtime.Host] = true
+		}
+	}
+	if len(hostRefSet) == 0 {
+		return hostNames, clusterNames
+	}
+	hostRefs := make([]types.ManagedObjectReference, 0, len(hostRefSet))
+	for ref := range hostRefSet {
+		hostRefs = append(hostRefs, ref)
+	}
+
+	pc := property.DefaultCollector(client.Client)
+	var hosts []mo.HostSystem
+	if err := pc.Retrieve(ctx, hostRefs, []string{"name", "parent"}, &hosts); err != nil {
+		log.Printf("Error fetching vCenter host properties: %v", err)
+		return hostNames, clusterNames
+	}
+
+	hostNameByRef := make(map[types.ManagedObjectReference]string, len(hosts))
+	hostClusterRef := make(map[types.ManagedObjectReference]types.ManagedObjectReference)
+	clusterRefSet := make(map[types.ManagedObjectReference]bool)
+	for _, host := range hosts {
+		hostNameByRef[host.Self] = host.Name
+		if host.Parent != nil && host.Parent.Type == "ClusterComputeResource" {
+			hostClusterRef[host.Self] = *host.Parent
+			clusterRefSet[*host.Parent] = true
+		}
+	}
+
+	clusterNameByRef := make(map[types.ManagedObjectReference]string, len(clusterRefSet))
+	if len(clusterRefSet) > 0 {
+		clusterRefs := make([]types.ManagedObjectReference, 0, len(clusterRefSet))
+		for ref := range clusterRefSet {
+			clusterRefs = append(clusterRefs, ref)
+		}
+		var clusters []mo.ClusterComputeResource
+		if err := pc.Retrieve(ctx, clusterRefs, []string{"name"}, &clusters); err != nil {
+			log.Printf("Error fetching vCenter cluster properties: %v", err)
+		} else {
+			for _, cluster := range clusters {
+				clusterNameByRef[cluster.Self] = cluster.Name
+			}
+		}
+	}
+
+	for _, vm := range vms {
+		if vm.Runtime.Host == nil {
+			continue
+		}
+		hostRef := *vm.Runtime.Host
+		hostNames[vm.Self] = hostNameByRef[hostRef]
+		if clusterRef, ok := hostClusterRef[hostRef]; ok {
+			clusterNames[vm.Self] = clusterNameByRef[clusterRef]
+		}
+	}
+	return hostNames, clusterNames
+}